@@ -4,12 +4,29 @@
 package storj
 
 import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
 	"database/sql/driver"
+	"encoding/base32"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"hash"
+	"io"
+	"math/big"
+	"math/bits"
+	mrand "math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
 
 	"github.com/zeebo/errs"
 )
@@ -20,6 +37,9 @@ var ErrPieceID = errs.Class("piece ID")
 // PieceID is the unique identifier for pieces.
 type PieceID [32]byte
 
+// PieceIDList is a slice of PieceIDs.
+type PieceIDList []PieceID
+
 // NewPieceID creates a piece ID.
 func NewPieceID() PieceID {
 	var id PieceID
@@ -36,11 +56,144 @@ func NewPieceID() PieceID {
 func PieceIDFromString(s string) (PieceID, error) {
 	idBytes, err := base32Encoding.DecodeString(s)
 	if err != nil {
-		return PieceID{}, ErrPieceID.Wrap(err)
+		return PieceID{}, pieceIDDecodeError(s, err)
 	}
 	return PieceIDFromBytes(idBytes)
 }
 
+// pieceIDDecodeError wraps a base32 decoding error of s, including the first
+// character outside of the base32 alphabet and its byte offset in s, when
+// there's one. The wrapped error reports the same offset, which otherwise
+// wouldn't count the newlines skipped by the decoder.
+func pieceIDDecodeError(s string, err error) error {
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if s[i] != '\r' && s[i] != '\n' && base32DecodeMap[s[i]] == 0xFF {
+			char := strconv.QuoteRune(r)
+			if r == utf8.RuneError && size == 1 {
+				char = strconv.Quote(s[i : i+1])
+			}
+			return ErrPieceID.New("invalid character %s at index %d: %w", char, i, base32.CorruptInputError(i))
+		}
+		i += size
+	}
+	return ErrPieceID.Wrap(err)
+}
+
+// pieceIDEncodedLen is the length of a base32 encoded piece ID without padding.
+const pieceIDEncodedLen = (len(PieceID{})*8 + 4) / 5
+
+// base32DecodeMap maps base32 characters to their values, 0xFF for invalid ones.
+var base32DecodeMap = func() (decodeMap [256]byte) {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	for i := range decodeMap {
+		decodeMap[i] = 0xFF
+	}
+	for i := 0; i < len(alphabet); i++ {
+		decodeMap[alphabet[i]] = byte(i)
+	}
+	return decodeMap
+}()
+
+// PieceIDFromStringInto decodes a base32 encoded piece ID string into id.
+//
+// It's equivalent to PieceIDFromString, but decodes canonical input directly
+// into id without allocating.
+func PieceIDFromStringInto(s string, id *PieceID) error {
+	if len(s) != pieceIDEncodedLen {
+		decoded, err := PieceIDFromString(s)
+		if err != nil {
+			return err
+		}
+		*id = decoded
+		return nil
+	}
+
+	var decoded PieceID
+	var acc uint64
+	var bits, n int
+	for i := 0; i < len(s); i++ {
+		v := base32DecodeMap[s[i]]
+		if v == 0xFF {
+			return pieceIDDecodeError(s, base32.CorruptInputError(i))
+		}
+		acc = acc<<5 | uint64(v)
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			decoded[n] = byte(acc >> bits)
+			n++
+		}
+	}
+	*id = decoded
+	return nil
+}
+
+// PieceIDFromStringLenient decodes a base32 encoded piece ID string, ignoring
+// surrounding whitespace and letter case.
+func PieceIDFromStringLenient(s string) (PieceID, error) {
+	return PieceIDFromString(strings.ToUpper(strings.TrimSpace(s)))
+}
+
+// PieceIDsFromStrings decodes a list of base32 encoded piece ID strings.
+// The returned error contains the index and the reason of every failure.
+func PieceIDsFromStrings(ss []string) (PieceIDList, error) {
+	ids := make(PieceIDList, 0, len(ss))
+	var idErrs []error
+	for i, s := range ss {
+		id, err := PieceIDFromString(s)
+		if err != nil {
+			idErrs = append(idErrs, ErrPieceID.New("index %d: %w", i, errors.Unwrap(err)))
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	if err := errs.Combine(idErrs...); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// LineError is an error of a single line returned by PieceIDsFromReader.
+type LineError struct {
+	Line int // Line is the 1-based line number.
+	Err  error
+}
+
+// Error implements the error interface.
+func (err LineError) Error() string { return fmt.Sprintf("line %d: %v", err.Line, err.Err) }
+
+// Unwrap returns the underlying error.
+func (err LineError) Unwrap() error { return err.Err }
+
+// PieceIDsFromReader decodes base32 encoded piece IDs from r, one per line.
+// Surrounding whitespace and empty lines are ignored. Lines that fail to
+// decode are reported in lineErrs, while decoding continues with the next
+// line.
+func PieceIDsFromReader(r io.Reader) (ids PieceIDList, lineErrs []LineError) {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		id, err := PieceIDFromString(text)
+		if err != nil {
+			lineErrs = append(lineErrs, LineError{Line: line, Err: err})
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if err := scanner.Err(); err != nil {
+		lineErrs = append(lineErrs, LineError{Line: line + 1, Err: ErrPieceID.Wrap(err)})
+	}
+	return ids, lineErrs
+}
+
 // PieceIDFromBytes converts a byte slice into a piece ID.
 func PieceIDFromBytes(b []byte) (PieceID, error) {
 	if len(b) != len(PieceID{}) {
@@ -52,27 +205,196 @@ func PieceIDFromBytes(b []byte) (PieceID, error) {
 	return id, nil
 }
 
+// ReadPieceID reads the raw bytes of a piece ID from r.
+func ReadPieceID(r io.Reader) (PieceID, error) {
+	var id PieceID
+	if _, err := io.ReadFull(r, id[:]); err != nil {
+		return PieceID{}, ErrPieceID.Wrap(err)
+	}
+	return id, nil
+}
+
+// PieceIDFromFixed converts a fixed-size array into a piece ID.
+func PieceIDFromFixed(b [32]byte) PieceID { return PieceID(b) }
+
 // IsZero returns whether piece ID is unassigned.
 func (id PieceID) IsZero() bool {
 	return id == PieceID{}
 }
 
+// LooksPlaceholder returns whether the piece ID looks like a placeholder rather
+// than a random or derived value: all bytes equal (e.g. all zeros or all ones)
+// or incrementing bytes (e.g. 0x00, 0x01, 0x02, ...).
+//
+// It's a cheap heuristic for pre-filtering, a false result doesn't guarantee
+// the piece ID is valid.
+func (id PieceID) LooksPlaceholder() bool {
+	repeated, incrementing := true, true
+	for i := 1; i < len(id); i++ {
+		repeated = repeated && id[i] == id[0]
+		incrementing = incrementing && id[i] == id[i-1]+1
+	}
+	return repeated || incrementing
+}
+
 // String representation of the piece ID.
+//
+// It's encoded with the standard base32 alphabet without padding, which
+// always results in 52 characters. The format is used for stored piece IDs
+// and must not change.
 func (id PieceID) String() string { return base32Encoding.EncodeToString(id.Bytes()) }
 
+// GoString returns a Go-syntax like representation of the piece ID, used by %#v.
+func (id PieceID) GoString() string { return "storj.PieceID(" + strconv.Quote(id.String()) + ")" }
+
+// FixedBytes returns the piece ID as a fixed-size array, e.g. for fixed-size
+// protobuf fields. The array is a copy, modifying it doesn't change id.
+func (id PieceID) FixedBytes() [32]byte { return id }
+
 // Bytes returns bytes of the piece ID.
+//
+// The slice is backed by the receiver, which is a copy of the piece ID, hence
+// mutating it doesn't change the original. Use BytesCopy when the intent to
+// get an independent slice should be explicit.
 func (id PieceID) Bytes() []byte { return id[:] }
 
+// BytesCopy returns a newly allocated copy of the piece ID bytes.
+func (id PieceID) BytesCopy() []byte {
+	b := make([]byte, len(id))
+	copy(b, id[:])
+	return b
+}
+
+// Clone returns a copy of the piece ID.
+//
+// PieceID is an array, so assignment already copies it. Clone exists to make
+// the intent explicit where piece IDs are copied out of shared structs.
+func (id PieceID) Clone() PieceID { return id }
+
+// InRange returns whether the piece ID is within the inclusive range
+// [low, high] of the 256-bit ID space. When low is greater than high, the
+// range wraps around the end of the space.
+func (id PieceID) InRange(low, high PieceID) bool {
+	if bytes.Compare(low[:], high[:]) <= 0 {
+		return bytes.Compare(low[:], id[:]) <= 0 && bytes.Compare(id[:], high[:]) <= 0
+	}
+	return bytes.Compare(low[:], id[:]) <= 0 || bytes.Compare(id[:], high[:]) <= 0
+}
+
+// Shard returns a stable index in [0, buckets) for the piece ID.
+//
+// The index is computed from the leading 8 bytes of the piece ID, which are
+// uniformly distributed for random and derived piece IDs. It panics when
+// buckets is not positive.
+func (id PieceID) Shard(buckets int) int {
+	if buckets <= 0 {
+		panic("bucket count must be positive")
+	}
+	hi, _ := bits.Mul64(binary.BigEndian.Uint64(id[:8]), uint64(buckets))
+	return int(hi)
+}
+
+// SameBytes returns whether the piece ID and the node ID consist of the same
+// bytes.
+//
+// PieceID and NodeID are distinct types, so comparing them with == doesn't
+// compile. Comparing them is almost always a bug; SameBytes makes the rare
+// intentional comparison explicit, instead of comparing their Bytes.
+func SameBytes(a PieceID, b NodeID) bool {
+	return a == PieceID(b)
+}
+
 // Derive a new PieceID from the current piece ID, the given storage node ID and piece number.
 func (id PieceID) Derive(storagenodeID NodeID, pieceNum int32) PieceID {
 	return id.Deriver().Derive(storagenodeID, pieceNum)
 }
 
+// DerivationStep contains the arguments of a single Derive call.
+type DerivationStep struct {
+	Node NodeID
+	Num  int32
+}
+
+// DeriveChain applies the derivation steps in order, deriving each piece ID
+// from the result of the previous step. No steps returns the piece ID itself.
+func (id PieceID) DeriveChain(steps []DerivationStep) PieceID {
+	for _, step := range steps {
+		id = id.Derive(step.Node, step.Num)
+	}
+	return id
+}
+
 // Deriver creates piece ID dervier for multiple derive operations.
 func (id PieceID) Deriver() PieceIDDeriver {
-	return PieceIDDeriver{
-		mac: hmac.New(sha512.New, id.Bytes()),
+	return id.DeriverForDomain("")
+}
+
+// DeriverForDomain creates a piece ID deriver, which mixes the domain into the
+// mac key, so that derivations for different domains never collide. The empty
+// domain results in the same piece IDs as Deriver.
+func (id PieceID) DeriverForDomain(domain string) PieceIDDeriver {
+	key := id.BytesCopy()
+	if domain != "" {
+		// HMAC zero-pads short keys, so terminate the domain with a non-zero
+		// byte. Otherwise domains only differing in trailing zero bytes, or
+		// "\x00" and the empty domain, would result in the same key.
+		key = append(key, domain...)
+		key = append(key, 0x01)
+	}
+	deriver := PieceIDDeriver{
+		parent: id,
+		mac:    hmac.New(sha512.New, key),
+		buf:    new([sha512.Size]byte),
 	}
+	// crypto/hmac stores the hash states after processing the padded key on
+	// the first Reset and restores them on the following ones, so do it here
+	// rather than in the first Derive call.
+	deriver.mac.Reset()
+	return deriver
+}
+
+// CachingDeriver creates a piece ID deriver that memoizes the derived piece IDs.
+func (id PieceID) CachingDeriver() *CachingPieceIDDeriver {
+	return &CachingPieceIDDeriver{
+		deriver: id.Deriver(),
+		cache:   map[derivationKey]PieceID{},
+	}
+}
+
+// DeriveParallel derives a piece ID for every node, using startNum+i as the
+// piece number for nodes[i]. The work is split across the given number of
+// goroutines, each using its own deriver. The result is in the same order as
+// nodes.
+func (id PieceID) DeriveParallel(nodes []NodeID, startNum int32, workers int) PieceIDList {
+	derived := make(PieceIDList, len(nodes))
+	if workers > len(nodes) {
+		workers = len(nodes)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	chunk := (len(nodes) + workers - 1) / workers
+
+	var wg sync.WaitGroup
+	for start := 0; start < len(nodes); start += chunk {
+		end := start + chunk
+		if end > len(nodes) {
+			end = len(nodes)
+		}
+
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			deriver := id.Deriver()
+			for i := start; i < end; i++ {
+				deriver.DeriveInto(nodes[i], startNum+int32(i), &derived[i])
+			}
+		}(start, end)
+	}
+	wg.Wait()
+
+	return derived
 }
 
 // Marshal serializes a piece ID.
@@ -80,6 +402,28 @@ func (id PieceID) Marshal() ([]byte, error) {
 	return id.Bytes(), nil
 }
 
+// PieceIDEncodingVersion is the version byte written by MarshalVersioned.
+const PieceIDEncodingVersion = 1
+
+// MarshalVersioned serializes a piece ID prefixed with PieceIDEncodingVersion.
+func (id PieceID) MarshalVersioned() []byte {
+	data := make([]byte, 1+len(id))
+	data[0] = PieceIDEncodingVersion
+	copy(data[1:], id[:])
+	return data
+}
+
+// PieceIDFromVersioned deserializes a piece ID serialized with MarshalVersioned.
+func PieceIDFromVersioned(data []byte) (PieceID, error) {
+	if len(data) == 0 {
+		return PieceID{}, ErrPieceID.New("missing encoding version")
+	}
+	if data[0] != PieceIDEncodingVersion {
+		return PieceID{}, ErrPieceID.New("unknown encoding version %d", data[0])
+	}
+	return PieceIDFromBytes(data[1:])
+}
+
 // MarshalTo serializes a piece ID into the passed byte slice.
 func (id *PieceID) MarshalTo(data []byte) (n int, err error) {
 	n = copy(data, id.Bytes())
@@ -98,7 +442,7 @@ func (id *PieceID) Size() int {
 	return len(id)
 }
 
-// MarshalText serializes a piece ID to a base32 string.
+// MarshalText serializes a piece ID to a base32 string. It never fails.
 func (id PieceID) MarshalText() ([]byte, error) {
 	return []byte(id.String()), nil
 }
@@ -108,18 +452,39 @@ func (id *PieceID) UnmarshalText(data []byte) error {
 	var err error
 	*id, err = PieceIDFromString(string(data))
 	if err != nil {
-		return err
+		return ErrPieceID.New("unable to unmarshal %q: %w", truncateText(data), errors.Unwrap(err))
 	}
 	return nil
 }
 
+// truncateText shortens data for inclusion in error messages.
+func truncateText(data []byte) string {
+	const maxLength = 64
+	if len(data) > maxLength {
+		return string(data[:maxLength]) + "..."
+	}
+	return string(data)
+}
+
 // Value set a PieceID to a database field.
+//
+// The zero PieceID results in 32 zero bytes, not NULL; use NullPieceID for
+// nullable fields. database/sql stores a nil *PieceID as NULL without calling
+// Value. The returned slice never aliases the piece ID.
 func (id PieceID) Value() (driver.Value, error) {
-	return id.Bytes(), nil
+	return id.BytesCopy(), nil
 }
 
 // Scan extracts a PieceID from a database field.
+//
+// A NULL field (nil src) results in the zero PieceID, hence callers that
+// need to detect NULL should check IsZero.
 func (id *PieceID) Scan(src interface{}) (err error) {
+	if src == nil {
+		*id = PieceID{}
+		return nil
+	}
+
 	b, ok := src.([]byte)
 	if !ok {
 		return ErrPieceID.New("PieceID Scan expects []byte")
@@ -129,23 +494,428 @@ func (id *PieceID) Scan(src interface{}) (err error) {
 	return err
 }
 
+// NullPieceID represents a PieceID that may be null.
+// NullPieceID implements the Scanner interface so it can be used
+// as a scan destination, similar to sql.NullString.
+type NullPieceID struct {
+	PieceID PieceID
+	Valid   bool // Valid is true if PieceID is not NULL
+}
+
+// Value implements sql/driver.Valuer interface.
+func (n NullPieceID) Value() (driver.Value, error) {
+	if !n.Valid {
+		return nil, nil
+	}
+	return n.PieceID.Value()
+}
+
+// Scan implements sql.Scanner interface.
+func (n *NullPieceID) Scan(src interface{}) error {
+	if src == nil {
+		n.PieceID, n.Valid = PieceID{}, false
+		return nil
+	}
+
+	n.Valid = true
+	return n.PieceID.Scan(src)
+}
+
+// ScanPieceIDs scans a single PieceID column from every row, e.g. of *sql.Rows.
+// When rows also has an Err method, like *sql.Rows, its error is checked after
+// the iteration.
+func ScanPieceIDs(rows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+}) (PieceIDList, error) {
+	var ids PieceIDList
+	for rows.Next() {
+		var id PieceID
+		if err := rows.Scan(&id); err != nil {
+			return nil, ErrPieceID.Wrap(err)
+		}
+		ids = append(ids, id)
+	}
+
+	if withErr, ok := rows.(interface{ Err() error }); ok {
+		if err := withErr.Err(); err != nil {
+			return nil, ErrPieceID.Wrap(err)
+		}
+	}
+	return ids, nil
+}
+
+// DeriveTracer, when not nil, is called with the inputs and the result of
+// every Derive and DeriveInto call. It's meant for debugging derivation
+// mismatches.
+//
+// It must be set before any derivation starts and unset after all of them
+// finished, as it's read without synchronization. It may be called
+// concurrently, e.g. by DeriveParallel.
+var DeriveTracer func(parent PieceID, node NodeID, num int32, result PieceID)
+
 // PieceIDDeriver can be used to for multiple derivation from the same PieceID
 // without need to initialize mac for each Derive call.
 type PieceIDDeriver struct {
-	mac hash.Hash
+	parent PieceID
+	mac    hash.Hash
+	// buf is scratch space for the mac input and output.
+	buf *[sha512.Size]byte
 }
 
 // Derive a new PieceID from the piece ID, the given storage node ID and piece number.
 // Initial mac is created from piece ID once while creating PieceDeriver and just
 // reset to initial state at the beginning of each call.
+//
+// The piece number is encoded as the big-endian two's complement bit pattern
+// of the int32, i.e. negative numbers map to the upper half of the uint32
+// range. Hence Derive(node, -1) and Derive(node, math.MaxInt32) differ. The
+// encoding is part of the wire contract and must not change.
+//
+// The derived piece ID is the first 32 bytes of the 64 byte HMAC-SHA512 sum,
+// the rest is discarded.
 func (pd PieceIDDeriver) Derive(storagenodeID NodeID, pieceNum int32) PieceID {
+	var derived PieceID
+	pd.DeriveInto(storagenodeID, pieceNum, &derived)
+	return derived
+}
+
+// DeriveInto is like Derive, but writes the derived piece ID into out instead
+// of returning it. It uses the scratch space of the deriver, so it doesn't
+// allocate once the mac has been reset for the first time.
+func (pd PieceIDDeriver) DeriveInto(storagenodeID NodeID, pieceNum int32, out *PieceID) {
 	pd.mac.Reset()
 
-	_, _ = pd.mac.Write(storagenodeID.Bytes()) // on hash.Hash write never returns an error
-	num := make([]byte, 4)
-	binary.BigEndian.PutUint32(num, uint32(pieceNum))
-	_, _ = pd.mac.Write(num) // on hash.Hash write never returns an error
+	input := pd.buf[:NodeIDSize+4]
+	copy(input, storagenodeID[:])
+	binary.BigEndian.PutUint32(input[NodeIDSize:], uint32(pieceNum))
+	_, _ = pd.mac.Write(input) // on hash.Hash write never returns an error
+
+	copy(out[:], pd.mac.Sum(pd.buf[:0]))
+
+	if tracer := DeriveTracer; tracer != nil {
+		tracer(pd.parent, storagenodeID, pieceNum, *out)
+	}
+}
+
+// DeriveStrict is like Derive, but returns an error when the storage node ID is
+// zero, which usually means that it was never initialized.
+func (pd PieceIDDeriver) DeriveStrict(storagenodeID NodeID, pieceNum int32) (PieceID, error) {
+	if storagenodeID.IsZero() {
+		return PieceID{}, ErrPieceID.New("unable to derive for zero node ID")
+	}
+	return pd.Derive(storagenodeID, pieceNum), nil
+}
+
+// Derive64 derives a new PieceID from the piece ID, the given storage node ID
+// and a 64-bit piece number, which is encoded as 8 big-endian bytes.
+//
+// The mac input differs in length from Derive, so Derive64 and Derive produce
+// different piece IDs for the same piece number by design.
+func (pd PieceIDDeriver) Derive64(storagenodeID NodeID, pieceNum int64) PieceID {
+	pd.mac.Reset()
+
+	input := pd.buf[:NodeIDSize+8]
+	copy(input, storagenodeID[:])
+	binary.BigEndian.PutUint64(input[NodeIDSize:], uint64(pieceNum))
+	_, _ = pd.mac.Write(input) // on hash.Hash write never returns an error
+
 	var derived PieceID
-	copy(derived[:], pd.mac.Sum(nil))
+	copy(derived[:], pd.mac.Sum(pd.buf[:0]))
+	return derived
+}
+
+// Iterator returns a pull-style iterator yielding the piece IDs derived for
+// the given storage node ID and piece numbers in [from, to). The returned
+// function reports false once the range is exhausted.
+//
+// The iterator shares the deriver, hence it must not be used concurrently
+// with other calls on pd.
+func (pd PieceIDDeriver) Iterator(storagenodeID NodeID, from, to int32) func() (PieceID, bool) {
+	next := int64(from)
+	return func() (PieceID, bool) {
+		if next >= int64(to) {
+			return PieceID{}, false
+		}
+		derived := pd.Derive(storagenodeID, int32(next))
+		next++
+		return derived, true
+	}
+}
+
+// DeriveRangeContext derives the piece IDs for the given storage node ID and
+// piece numbers in [from, to), calling fn for each of them in order.
+//
+// It stops at the first error returned by fn or when ctx is canceled, in which
+// case the context error is returned.
+func (pd PieceIDDeriver) DeriveRangeContext(ctx context.Context, storagenodeID NodeID, from, to int32, fn func(PieceID) error) error {
+	for num := int64(from); num < int64(to); num++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(pd.Derive(storagenodeID, int32(num))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LeadingByteHistogram counts the piece IDs by the value of their first byte.
+func (list PieceIDList) LeadingByteHistogram() (histogram [256]int) {
+	for _, id := range list {
+		histogram[id[0]]++
+	}
+	return histogram
+}
+
+// ContainsConstantTime returns whether the list contains id.
+//
+// Every entry is compared in constant time and the whole list is always
+// scanned, so the duration depends only on the length of the list and not on
+// whether or where id is found. It's O(n), hence it's only meant for small
+// security sensitive sets; use a map for anything else.
+func (list PieceIDList) ContainsConstantTime(id PieceID) bool {
+	return list.containsConstantTime(id, subtle.ConstantTimeCompare)
+}
+
+// containsConstantTime implements ContainsConstantTime using compare, which
+// allows tests to verify that every entry is compared.
+func (list PieceIDList) containsConstantTime(id PieceID, compare func(x, y []byte) int) bool {
+	found := 0
+	for i := range list {
+		found |= compare(list[i][:], id[:])
+	}
+	return found == 1
+}
+
+// Sample returns n distinct entries of the list, selected pseudo-randomly from
+// the seed, so that the same list and seed always result in the same sample.
+// When n is at least the length of the list, all piece IDs are returned.
+func (list PieceIDList) Sample(n int, seed int64) PieceIDList {
+	if n >= len(list) {
+		return append(PieceIDList(nil), list...)
+	}
+	if n <= 0 {
+		return PieceIDList{}
+	}
+
+	// partial Fisher-Yates shuffle of a copy
+	shuffled := append(PieceIDList(nil), list...)
+	rng := mrand.New(mrand.NewSource(seed))
+	for i := 0; i < n; i++ {
+		j := i + rng.Intn(len(shuffled)-i)
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	}
+	return shuffled[:n:n]
+}
+
+// MarshalBinary serializes the piece IDs by concatenating their bytes.
+func (list PieceIDList) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, len(list)*len(PieceID{}))
+	for _, id := range list {
+		data = append(data, id[:]...)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary deserializes piece IDs serialized with MarshalBinary.
+func (list *PieceIDList) UnmarshalBinary(data []byte) error {
+	if len(data)%len(PieceID{}) != 0 {
+		return ErrPieceID.New("invalid piece ID list length %d; must be a multiple of %d", len(data), len(PieceID{}))
+	}
+
+	ids := make(PieceIDList, len(data)/len(PieceID{}))
+	for i := range ids {
+		copy(ids[i][:], data[i*len(PieceID{}):])
+	}
+	*list = ids
+	return nil
+}
+
+// CachingPieceIDDeriver derives piece IDs like PieceIDDeriver, but keeps every
+// derived piece ID in memory and returns it on repeated calls with the same
+// arguments.
+//
+// The cache is never evicted, so it must only be used for a bounded set of
+// node IDs and piece numbers, e.g. within a single request. It's not safe for
+// concurrent use.
+type CachingPieceIDDeriver struct {
+	deriver PieceIDDeriver
+	cache   map[derivationKey]PieceID
+}
+
+// derivationKey is the key of CachingPieceIDDeriver.cache.
+type derivationKey struct {
+	node NodeID
+	num  int32
+}
+
+// Derive returns the derived piece ID for the storage node ID and piece number.
+func (pd *CachingPieceIDDeriver) Derive(storagenodeID NodeID, pieceNum int32) PieceID {
+	key := derivationKey{node: storagenodeID, num: pieceNum}
+	if derived, ok := pd.cache[key]; ok {
+		return derived
+	}
+
+	derived := pd.deriver.Derive(storagenodeID, pieceNum)
+	pd.cache[key] = derived
 	return derived
 }
+
+// Len returns the number of cached piece IDs.
+func (pd *CachingPieceIDDeriver) Len() int { return len(pd.cache) }
+
+// NearestNodes returns the k nodes closest to target by XOR distance, ordered
+// from the closest. Equal distances, which only happen for duplicate nodes,
+// are ordered by their index in nodes.
+//
+// It keeps a bounded heap of the k best candidates instead of sorting all
+// nodes.
+func NearestNodes(target PieceID, nodes []NodeID, k int) []NodeID {
+	if k > len(nodes) {
+		k = len(nodes)
+	}
+	if k <= 0 {
+		return nil
+	}
+
+	candidates := make(nodeDistanceHeap, 0, k)
+	for i, node := range nodes {
+		candidate := nodeDistance{index: i, node: node}
+		for b := range candidate.distance {
+			candidate.distance[b] = target[b] ^ node[b]
+		}
+
+		if len(candidates) < k {
+			heap.Push(&candidates, candidate)
+		} else if candidate.less(candidates[0]) {
+			candidates[0] = candidate
+			heap.Fix(&candidates, 0)
+		}
+	}
+
+	nearest := make([]NodeID, len(candidates))
+	for i := len(nearest) - 1; i >= 0; i-- {
+		nearest[i] = heap.Pop(&candidates).(nodeDistance).node
+	}
+	return nearest
+}
+
+// nodeDistance is a node with its distance to a target.
+type nodeDistance struct {
+	index    int
+	node     NodeID
+	distance [NodeIDSize]byte
+}
+
+// less returns whether a is closer than b.
+func (a nodeDistance) less(b nodeDistance) bool {
+	if c := bytes.Compare(a.distance[:], b.distance[:]); c != 0 {
+		return c < 0
+	}
+	return a.index < b.index
+}
+
+// nodeDistanceHeap is a max-heap of nodes by distance (implements heap.Interface).
+type nodeDistanceHeap []nodeDistance
+
+func (h nodeDistanceHeap) Len() int            { return len(h) }
+func (h nodeDistanceHeap) Less(i, j int) bool  { return h[j].less(h[i]) }
+func (h nodeDistanceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nodeDistanceHeap) Push(x interface{}) { *h = append(*h, x.(nodeDistance)) }
+func (h *nodeDistanceHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// PieceIDPartitions returns the n+1 boundaries dividing the piece ID space into
+// n equally sized partitions. Partition i contains the piece IDs in
+// [boundaries[i], boundaries[i+1]), except for the last one, which also
+// contains its upper boundary, the maximum piece ID.
+//
+// It panics when n is not positive.
+func PieceIDPartitions(n int) []PieceID {
+	if n <= 0 {
+		panic("partition count must be positive")
+	}
+
+	space := new(big.Int).Lsh(big.NewInt(1), uint(len(PieceID{})*8))
+
+	boundaries := make([]PieceID, n+1)
+	for i := 1; i < n; i++ {
+		boundary := new(big.Int).Mul(space, big.NewInt(int64(i)))
+		boundary.Div(boundary, big.NewInt(int64(n)))
+		boundary.FillBytes(boundaries[i][:])
+	}
+	for i := range boundaries[n] {
+		boundaries[n][i] = 0xFF
+	}
+	return boundaries
+}
+
+// SelfTestDerivation derives iterations piece IDs from a random parent, across
+// synthetic node IDs and piece numbers, and returns an error when any two of
+// them collide. It's meant as a quick sanity check, e.g. during startup.
+func SelfTestDerivation(iterations int) error {
+	const piecesPerNode = 16
+
+	deriver := NewPieceID().Deriver()
+	seen := make(map[PieceID]struct{}, iterations)
+
+	var node NodeID
+	for i := 0; i < iterations; i++ {
+		binary.BigEndian.PutUint64(node[:], uint64(i/piecesPerNode))
+		num := int32(i % piecesPerNode)
+
+		derived := deriver.Derive(node, num)
+		if _, ok := seen[derived]; ok {
+			return ErrPieceID.New("derivation collision for node %v and piece number %d", node, num)
+		}
+		seen[derived] = struct{}{}
+	}
+	return nil
+}
+
+// VerifyPieceContent returns whether the SHA-256 hash of data matches the
+// expected piece ID, comparing in constant time.
+//
+// It's only meaningful for content-addressed pieces, whose piece ID is the
+// hash of their data. Derived and random piece IDs never verify.
+func VerifyPieceContent(expected PieceID, data []byte) bool {
+	hash := sha256.Sum256(data)
+	return subtle.ConstantTimeCompare(hash[:], expected[:]) == 1
+}
+
+// PieceIDInterner deduplicates piece IDs, so that equal piece IDs share the
+// same storage.
+//
+// Intern returns a pointer, since a PieceID value is always a copy. Sharing
+// only saves memory when the same piece IDs are held many times, e.g. when
+// deriving for overlapping node sets; otherwise the map and the pointers only
+// add overhead. The interned piece IDs are kept until the interner is
+// released. It's not safe for concurrent use.
+type PieceIDInterner struct {
+	ids map[PieceID]*PieceID
+}
+
+// NewPieceIDInterner creates an empty piece ID interner.
+func NewPieceIDInterner() *PieceIDInterner {
+	return &PieceIDInterner{ids: map[PieceID]*PieceID{}}
+}
+
+// Intern returns the canonical shared copy of id. The returned piece ID must
+// not be modified.
+func (interner *PieceIDInterner) Intern(id PieceID) *PieceID {
+	if canonical, ok := interner.ids[id]; ok {
+		return canonical
+	}
+	canonical := new(PieceID)
+	*canonical = id
+	interner.ids[id] = canonical
+	return canonical
+}
+
+// Len returns the number of distinct interned piece IDs.
+func (interner *PieceIDInterner) Len() int { return len(interner.ids) }
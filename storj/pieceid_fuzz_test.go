@@ -0,0 +1,61 @@
+// Copyright (C) 2022 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+//go:build go1.18
+// +build go1.18
+
+package storj_test
+
+import (
+	"testing"
+
+	"storj.io/common/storj"
+)
+
+func FuzzPieceIDRoundTrip(f *testing.F) {
+	f.Add([]byte(""))
+	f.Add(make([]byte, 32))
+	f.Add([]byte("\x01\x02\x03\x04\x05"))
+	f.Add([]byte("likn43kilfzd"))
+	f.Add([]byte("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"))
+	f.Add([]byte("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAB"))
+	f.Add([]byte("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="))
+	f.Add([]byte("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA\nAAAA"))
+	f.Add([]byte("7777777777777777777777777777777777777777777777777777"))
+	f.Add([]byte("\xff\xfe\xfd\xfc\xfb\xfa\xf9\xf8\xf7\xf6\xf5\xf4\xf3\xf2\xf1\xf0\xef\xee\xed\xec\xeb\xea\xe9\xe8\xe7\xe6\xe5\xe4\xe3\xe2\xe1\xe0"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if id, err := storj.PieceIDFromBytes(data); err == nil {
+			again, err := storj.PieceIDFromBytes(id.Bytes())
+			if err != nil || again != id {
+				t.Fatalf("bytes round-trip failed for %x: %v", data, err)
+			}
+		}
+
+		if id, err := storj.PieceIDFromString(string(data)); err == nil {
+			again, err := storj.PieceIDFromString(id.String())
+			if err != nil || again != id {
+				t.Fatalf("string round-trip failed for %q: %v", data, err)
+			}
+		}
+	})
+}
+
+func FuzzDerive(f *testing.F) {
+	f.Add(make([]byte, 32), make([]byte, 32), int32(0))
+	f.Add([]byte("\x01\x02\x03\x04\x05"), []byte("\x06\x07"), int32(-1))
+	f.Add([]byte("\xff\xff\xff\xff"), []byte(""), int32(2147483647))
+	f.Add([]byte(""), []byte("\xff\xff\xff\xff\xff\xff\xff\xff"), int32(-2147483648))
+
+	f.Fuzz(func(t *testing.T, parent, node []byte, pieceNum int32) {
+		var pieceID storj.PieceID
+		copy(pieceID[:], parent)
+		var nodeID storj.NodeID
+		copy(nodeID[:], node)
+
+		derived := pieceID.Derive(nodeID, pieceNum)
+		if derived != pieceID.Deriver().Derive(nodeID, pieceNum) {
+			t.Fatal("Derive and Deriver().Derive mismatch")
+		}
+	})
+}
@@ -0,0 +1,26 @@
+// Copyright (C) 2022 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package storj
+
+import (
+	"crypto/subtle"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPieceIDList_ContainsConstantTimeComparesAll(t *testing.T) {
+	list := PieceIDList{NewPieceID(), NewPieceID(), NewPieceID(), NewPieceID()}
+
+	for _, id := range append(list, NewPieceID()) {
+		compared := 0
+		contains := list.containsConstantTime(id, func(x, y []byte) int {
+			compared++
+			return subtle.ConstantTimeCompare(x, y)
+		})
+		require.Equal(t, list.ContainsConstantTime(id), contains)
+		// the scan must not stop at a match
+		require.Equal(t, len(list), compared)
+	}
+}
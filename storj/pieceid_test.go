@@ -4,7 +4,19 @@
 package storj_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -12,6 +24,7 @@ import (
 
 	"storj.io/common/identity/testidentity"
 	"storj.io/common/storj"
+	"storj.io/common/testrand"
 )
 
 func TestNewPieceID(t *testing.T) {
@@ -109,6 +122,983 @@ func TestPieceID_UnmarshalJSON(t *testing.T) {
 	assert.Error(t, json.Unmarshal([]byte(`{}`), &pieceid))
 }
 
+func TestPieceID_Scan(t *testing.T) {
+	expected := storj.NewPieceID()
+
+	var id storj.PieceID
+	require.NoError(t, id.Scan(expected.Bytes()))
+	require.Equal(t, expected, id)
+
+	require.NoError(t, id.Scan(nil))
+	require.True(t, id.IsZero())
+
+	require.Error(t, id.Scan("not bytes"))
+	require.Error(t, id.Scan([]byte{1, 2, 3}))
+}
+
+func TestNullPieceID(t *testing.T) {
+	id := storj.NewPieceID()
+	expected := storj.NullPieceID{PieceID: id, Valid: true}
+
+	var a storj.NullPieceID
+	require.NoError(t, a.Scan(id.Bytes()))
+	require.Equal(t, expected, a)
+
+	require.NoError(t, a.Scan(nil))
+	require.Equal(t, storj.NullPieceID{}, a)
+
+	value, err := expected.Value()
+	require.NoError(t, err)
+	require.Equal(t, id.Bytes(), value)
+
+	value, err = storj.NullPieceID{}.Value()
+	require.NoError(t, err)
+	require.Nil(t, value)
+}
+
+func TestPieceIDDeriver_Iterator(t *testing.T) {
+	pieceID := storj.NewPieceID()
+	deriver := pieceID.Deriver()
+	n0 := testidentity.MustPregeneratedIdentity(0, storj.LatestIDVersion()).ID
+
+	var expected, got []storj.PieceID
+	for num := int32(-2); num < 5; num++ {
+		expected = append(expected, pieceID.Derive(n0, num))
+	}
+
+	next := deriver.Iterator(n0, -2, 5)
+	for derived, ok := next(); ok; derived, ok = next() {
+		got = append(got, derived)
+	}
+	require.Equal(t, expected, got)
+
+	_, ok := next()
+	require.False(t, ok)
+
+	_, ok = deriver.Iterator(n0, 5, 5)()
+	require.False(t, ok)
+}
+
+func TestPieceIDDeriver_DeriveRangeContext(t *testing.T) {
+	pieceID := storj.NewPieceID()
+	deriver := pieceID.Deriver()
+	n0 := testidentity.MustPregeneratedIdentity(0, storj.LatestIDVersion()).ID
+
+	var got []storj.PieceID
+	err := deriver.DeriveRangeContext(context.Background(), n0, 0, 10, func(derived storj.PieceID) error {
+		got = append(got, derived)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, got, 10)
+	for i, derived := range got {
+		require.Equal(t, pieceID.Derive(n0, int32(i)), derived)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := 0
+	err = deriver.DeriveRangeContext(ctx, n0, 0, 1000, func(storj.PieceID) error {
+		calls++
+		if calls == 5 {
+			cancel()
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 5, calls)
+
+	errStop := errors.New("stop")
+	err = deriver.DeriveRangeContext(context.Background(), n0, 0, 1000, func(storj.PieceID) error {
+		return errStop
+	})
+	require.ErrorIs(t, err, errStop)
+}
+
+func TestPieceID_BytesCopy(t *testing.T) {
+	id := storj.NewPieceID()
+	original := id
+
+	b := id.BytesCopy()
+	require.Equal(t, id.Bytes(), b)
+	for i := range b {
+		b[i] ^= 0xFF
+	}
+	require.Equal(t, original, id)
+
+	b = id.Bytes()
+	for i := range b {
+		b[i] ^= 0xFF
+	}
+	require.Equal(t, original, id)
+}
+
+func TestPieceID_ValueScanRoundTrip(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		expected := storj.NewPieceID()
+
+		value, err := expected.Value()
+		require.NoError(t, err)
+
+		// simulate a driver that reuses its buffer after Scan
+		buffer := append([]byte(nil), value.([]byte)...)
+
+		var id storj.PieceID
+		require.NoError(t, id.Scan(buffer))
+		require.Equal(t, expected, id)
+
+		for k := range buffer {
+			buffer[k] = 0
+		}
+		require.Equal(t, expected, id)
+	}
+}
+
+func TestPieceID_Shard(t *testing.T) {
+	const samples = 20000
+
+	ids := make([]storj.PieceID, samples)
+	for i := range ids {
+		ids[i] = storj.NewPieceID()
+	}
+
+	for _, buckets := range []int{1, 2, 7, 16, 100} {
+		counts := make([]int, buckets)
+		for _, id := range ids {
+			shard := id.Shard(buckets)
+			require.True(t, 0 <= shard && shard < buckets)
+			require.Equal(t, shard, id.Shard(buckets), "stable")
+			counts[shard]++
+		}
+
+		// chi-square statistic against the uniform distribution, which has
+		// mean df and standard deviation sqrt(2*df).
+		expected := float64(samples) / float64(buckets)
+		var chi2 float64
+		for _, count := range counts {
+			d := float64(count) - expected
+			chi2 += d * d / expected
+		}
+		df := float64(buckets - 1)
+		assert.LessOrEqual(t, chi2, df+6*math.Sqrt(2*df)+10, "buckets=%d counts=%v", buckets, counts)
+	}
+
+	require.Panics(t, func() { storj.NewPieceID().Shard(0) })
+	require.Panics(t, func() { storj.NewPieceID().Shard(-1) })
+}
+
+// goldenDerivationInputs returns the fixed parent piece ID and node ID used
+// by the golden derivation tests.
+func goldenDerivationInputs() (parent storj.PieceID, node storj.NodeID) {
+	for i := range parent {
+		parent[i] = byte(i)
+		node[i] = byte(32 + i)
+	}
+	return parent, node
+}
+
+func TestPieceID_DeriveNegativePieceNum(t *testing.T) {
+	parent, node := goldenDerivationInputs()
+
+	minusOne := parent.Derive(node, -1)
+	maxInt32 := parent.Derive(node, math.MaxInt32)
+	require.NotEqual(t, minusOne, maxInt32)
+
+	// golden values, these must never change
+	require.Equal(t, "HSRL4RDXOCOFVINZJ3GPCEUM3Q5HCN5LE5GM7PX63KJ63CVVRFRA", minusOne.String())
+	require.Equal(t, "JNX7FKTZXNRUVBLI5VPZWEXSP5RSUTC7KXEUG22BDI5BCDXTCNUA", maxInt32.String())
+}
+
+func TestPieceIDList_Binary(t *testing.T) {
+	for _, count := range []int{0, 1, 5} {
+		list := make(storj.PieceIDList, count)
+		for i := range list {
+			list[i] = storj.NewPieceID()
+		}
+
+		data, err := list.MarshalBinary()
+		require.NoError(t, err)
+		require.Len(t, data, count*len(storj.PieceID{}))
+
+		var decoded storj.PieceIDList
+		require.NoError(t, decoded.UnmarshalBinary(data))
+		require.Equal(t, list, decoded)
+	}
+
+	var decoded storj.PieceIDList
+	err := decoded.UnmarshalBinary(make([]byte, 33))
+	require.Error(t, err)
+	require.True(t, storj.ErrPieceID.Has(err))
+}
+
+func TestPieceID_Clone(t *testing.T) {
+	id := storj.NewPieceID()
+	clone := id.Clone()
+	require.Equal(t, id, clone)
+
+	clone[0] ^= 0xFF
+	require.NotEqual(t, id, clone)
+}
+
+func TestPieceID_GoString(t *testing.T) {
+	id := storj.NewPieceID()
+	require.Equal(t, `storj.PieceID("`+id.String()+`")`, fmt.Sprintf("%#v", id))
+	require.Contains(t, fmt.Sprintf("%#v", struct{ ID storj.PieceID }{id}), id.String())
+}
+
+func TestPieceIDFromStringLenient(t *testing.T) {
+	id := storj.NewPieceID()
+
+	decoded, err := storj.PieceIDFromStringLenient(" \t" + strings.ToLower(id.String()) + "\r\n")
+	require.NoError(t, err)
+	require.Equal(t, id, decoded)
+
+	decoded, err = storj.PieceIDFromStringLenient(id.String())
+	require.NoError(t, err)
+	require.Equal(t, id, decoded)
+
+	_, err = storj.PieceIDFromString(strings.ToLower(id.String()))
+	require.Error(t, err)
+
+	_, err = storj.PieceIDFromStringLenient("likn43kilfzd")
+	require.Error(t, err)
+}
+
+func TestPieceID_InRange(t *testing.T) {
+	id := func(b byte) storj.PieceID { return storj.PieceID{b} }
+	maxID := storj.PieceID{}
+	for i := range maxID {
+		maxID[i] = 0xFF
+	}
+
+	for _, tc := range []struct {
+		id, low, high storj.PieceID
+		in            bool
+	}{
+		{id(0x10), id(0x10), id(0x20), true},
+		{id(0x15), id(0x10), id(0x20), true},
+		{id(0x20), id(0x10), id(0x20), true},
+		{id(0x0F), id(0x10), id(0x20), false},
+		{storj.PieceID{0x20, 1}, id(0x10), id(0x20), false},
+		{id(0x10), id(0x10), id(0x10), true},
+		{storj.PieceID{}, storj.PieceID{}, maxID, true},
+		{maxID, storj.PieceID{}, maxID, true},
+
+		// wrap-around
+		{id(0xF0), id(0xE0), id(0x10), true},
+		{maxID, id(0xE0), id(0x10), true},
+		{storj.PieceID{}, id(0xE0), id(0x10), true},
+		{id(0x10), id(0xE0), id(0x10), true},
+		{id(0x80), id(0xE0), id(0x10), false},
+	} {
+		assert.Equal(t, tc.in, tc.id.InRange(tc.low, tc.high), "%x in [%x, %x]", tc.id[:2], tc.low[:2], tc.high[:2])
+	}
+}
+
+func TestPieceID_UnmarshalTextError(t *testing.T) {
+	var id storj.PieceID
+
+	err := id.UnmarshalText([]byte("AB!D"))
+	require.Error(t, err)
+	require.True(t, storj.ErrPieceID.Has(err))
+	require.Contains(t, err.Error(), `"AB!D"`)
+	require.Contains(t, err.Error(), "illegal base32 data")
+	require.Equal(t, 1, strings.Count(err.Error(), "piece ID:"))
+
+	err = id.UnmarshalText([]byte("AAAA"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `"AAAA"`)
+	require.Contains(t, err.Error(), "not enough bytes")
+
+	long := strings.Repeat("!", 1000)
+	err = id.UnmarshalText([]byte(long))
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), long)
+	require.Contains(t, err.Error(), "...")
+}
+
+func TestPieceID_DeriveChain(t *testing.T) {
+	id := storj.NewPieceID()
+	n0 := testidentity.MustPregeneratedIdentity(0, storj.LatestIDVersion()).ID
+	n1 := testidentity.MustPregeneratedIdentity(1, storj.LatestIDVersion()).ID
+
+	require.Equal(t, id, id.DeriveChain(nil))
+	require.Equal(t, id.Derive(n0, 3), id.DeriveChain([]storj.DerivationStep{{Node: n0, Num: 3}}))
+	require.Equal(t,
+		id.Derive(n0, 3).Derive(n1, 7),
+		id.DeriveChain([]storj.DerivationStep{{Node: n0, Num: 3}, {Node: n1, Num: 7}}))
+}
+
+func TestPieceIDList_LeadingByteHistogram(t *testing.T) {
+	list := storj.PieceIDList{
+		{0x00, 1}, {0x00, 2}, {0x7F}, {0xFF, 3}, {0xFF}, {0xFF, 4},
+	}
+
+	var expected [256]int
+	expected[0x00] = 2
+	expected[0x7F] = 1
+	expected[0xFF] = 3
+	require.Equal(t, expected, list.LeadingByteHistogram())
+
+	require.Equal(t, [256]int{}, storj.PieceIDList(nil).LeadingByteHistogram())
+}
+
+func TestPieceIDDeriver_DeriveInto(t *testing.T) {
+	pieceID := storj.NewPieceID()
+	deriver := pieceID.Deriver()
+
+	for k := 0; k < 5; k++ {
+		n := testidentity.MustPregeneratedIdentity(k, storj.LatestIDVersion()).ID
+		for _, num := range []int32{0, 1, 100, -1} {
+			var derived storj.PieceID
+			deriver.DeriveInto(n, num, &derived)
+			require.Equal(t, pieceID.Derive(n, num), derived)
+		}
+	}
+}
+
+func TestPieceID_Value(t *testing.T) {
+	value, err := storj.PieceID{}.Value()
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, 32), value)
+
+	id := storj.NewPieceID()
+	original := id
+
+	value, err = id.Value()
+	require.NoError(t, err)
+	b := value.([]byte)
+	require.Equal(t, id.Bytes(), b)
+
+	for i := range b {
+		b[i] ^= 0xFF
+	}
+	require.Equal(t, original, id)
+}
+
+func TestSameBytes(t *testing.T) {
+	// zero values only compare equal via the explicit call
+	require.True(t, storj.SameBytes(storj.PieceID{}, storj.NodeID{}))
+
+	id := storj.NewPieceID()
+	require.True(t, storj.SameBytes(id, storj.NodeID(id)))
+	require.False(t, storj.SameBytes(id, storj.NodeID{}))
+	require.False(t, storj.SameBytes(storj.PieceID{}, storj.NodeID{1}))
+}
+
+func TestPieceID_CachingDeriver(t *testing.T) {
+	pieceID := storj.NewPieceID()
+	deriver := pieceID.CachingDeriver()
+
+	n0 := testidentity.MustPregeneratedIdentity(0, storj.LatestIDVersion()).ID
+	n1 := testidentity.MustPregeneratedIdentity(1, storj.LatestIDVersion()).ID
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, pieceID.Derive(n0, 0), deriver.Derive(n0, 0))
+		require.Equal(t, pieceID.Derive(n0, 1), deriver.Derive(n0, 1))
+		require.Equal(t, pieceID.Derive(n1, 0), deriver.Derive(n1, 0))
+	}
+	require.Equal(t, 3, deriver.Len())
+}
+
+func TestPieceIDFromStringInto(t *testing.T) {
+	inputs := []string{
+		"",
+		"likn43kilfzd",
+		strings.Repeat("A", 52),
+		strings.Repeat("A", 51) + "!",
+		strings.Repeat("A", 50) + "\nAA",
+		strings.Repeat("A", 40) + "\n" + strings.Repeat("A", 12),
+		strings.Repeat("7", 52),
+	}
+	for i := 0; i < 10; i++ {
+		inputs = append(inputs, storj.NewPieceID().String())
+	}
+	for i := 0; i < 100; i++ {
+		mutated := []byte(storj.NewPieceID().String())
+		mutated[testrand.Intn(len(mutated))] = byte(testrand.Intn(256))
+		inputs = append(inputs, string(mutated))
+	}
+
+	for _, input := range inputs {
+		expected, expectedErr := storj.PieceIDFromString(input)
+
+		var id storj.PieceID
+		err := storj.PieceIDFromStringInto(input, &id)
+		if expectedErr != nil {
+			require.Error(t, err, "%q", input)
+			continue
+		}
+		require.NoError(t, err, "%q", input)
+		require.Equal(t, expected, id, "%q", input)
+	}
+}
+
+func TestPieceIDFromString_InvalidCharacter(t *testing.T) {
+	valid := storj.NewPieceID().String()
+	input := valid[:10] + "!" + valid[11:]
+
+	_, err := storj.PieceIDFromString(input)
+	require.Error(t, err)
+	require.True(t, storj.ErrPieceID.Has(err))
+	require.Contains(t, err.Error(), `'!'`)
+	require.Contains(t, err.Error(), "index 10")
+
+	var corrupt base32.CorruptInputError
+	require.True(t, errors.As(err, &corrupt))
+
+	var id storj.PieceID
+	err = storj.PieceIDFromStringInto(input, &id)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `'!'`)
+	require.Contains(t, err.Error(), "index 10")
+
+	_, err = storj.PieceIDFromString("a" + valid[1:])
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `'a'`)
+	require.Contains(t, err.Error(), "index 0")
+
+	err = id.UnmarshalText([]byte(input))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `'!'`)
+	require.Contains(t, err.Error(), "index 10")
+	require.True(t, errors.As(err, &corrupt))
+
+	// newlines are skipped by the decoder, but still count for the index
+	_, err = storj.PieceIDFromString("AAAA\nAA!A")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `'!' at index 7`)
+	require.Contains(t, err.Error(), "input byte 7")
+	require.True(t, errors.As(err, &corrupt))
+	require.Equal(t, base32.CorruptInputError(7), corrupt)
+
+	// multi-byte characters are reported as a whole
+	_, err = storj.PieceIDFromString("AAé" + valid[4:])
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `'é' at index 2`)
+
+	_, err = storj.PieceIDFromString("AA\xff" + valid[3:])
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `"\xff" at index 2`)
+}
+
+func TestPieceID_DeriveParallel(t *testing.T) {
+	pieceID := storj.NewPieceID()
+
+	nodes := make([]storj.NodeID, 37)
+	for i := range nodes {
+		nodes[i] = testrand.NodeID()
+	}
+
+	expected := make(storj.PieceIDList, len(nodes))
+	for i, node := range nodes {
+		expected[i] = pieceID.Derive(node, 5+int32(i))
+	}
+
+	for _, workers := range []int{-1, 0, 1, 2, 3, 8, 37, 100} {
+		require.Equal(t, expected, pieceID.DeriveParallel(nodes, 5, workers), "workers=%d", workers)
+	}
+
+	require.Empty(t, pieceID.DeriveParallel(nil, 0, 4))
+}
+
+func TestPieceIDList_ContainsConstantTime(t *testing.T) {
+	list := storj.PieceIDList{storj.NewPieceID(), storj.NewPieceID(), storj.NewPieceID()}
+
+	for _, id := range list {
+		require.True(t, list.ContainsConstantTime(id))
+	}
+	require.False(t, list.ContainsConstantTime(storj.NewPieceID()))
+	require.False(t, list.ContainsConstantTime(storj.PieceID{}))
+	require.False(t, storj.PieceIDList(nil).ContainsConstantTime(storj.PieceID{}))
+
+	// duplicates
+	list = append(list, list[0])
+	require.True(t, list.ContainsConstantTime(list[0]))
+}
+
+func TestPieceID_MarshalVersioned(t *testing.T) {
+	id := storj.NewPieceID()
+
+	data := id.MarshalVersioned()
+	require.Len(t, data, 33)
+	require.Equal(t, byte(storj.PieceIDEncodingVersion), data[0])
+
+	decoded, err := storj.PieceIDFromVersioned(data)
+	require.NoError(t, err)
+	require.Equal(t, id, decoded)
+
+	unknown := append([]byte{2}, id.Bytes()...)
+	_, err = storj.PieceIDFromVersioned(unknown)
+	require.Error(t, err)
+	require.True(t, storj.ErrPieceID.Has(err))
+
+	_, err = storj.PieceIDFromVersioned(nil)
+	require.Error(t, err)
+
+	_, err = storj.PieceIDFromVersioned(data[:20])
+	require.Error(t, err)
+}
+
+func TestReadPieceID(t *testing.T) {
+	a, b := storj.NewPieceID(), storj.NewPieceID()
+	r := bytes.NewReader(append(a.Bytes(), b.Bytes()...))
+
+	id, err := storj.ReadPieceID(r)
+	require.NoError(t, err)
+	require.Equal(t, a, id)
+
+	id, err = storj.ReadPieceID(r)
+	require.NoError(t, err)
+	require.Equal(t, b, id)
+
+	_, err = storj.ReadPieceID(r)
+	require.True(t, storj.ErrPieceID.Has(err))
+	require.ErrorIs(t, err, io.EOF)
+
+	_, err = storj.ReadPieceID(bytes.NewReader(a.Bytes()[:31]))
+	require.True(t, storj.ErrPieceID.Has(err))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestPieceID_DeriveGolden(t *testing.T) {
+	// The derivation is a wire contract: these values must be the same on
+	// every platform and must never change.
+	parent, node := goldenDerivationInputs()
+
+	for _, tc := range []struct {
+		num      int32
+		expected string
+	}{
+		{0, "YWQMMJZXJHBI4VFULVYAT5GDPH5Y62UZPAPLNLZE4YLJCPBWRRNA"},
+		{1, "XAWBGGPAUE26DNNGJKUEEKJNNOL3WVDNWX6QGAZFEAA5CUM3HSWA"},
+		{2, "SM6QIX5SPU4G3RSEJKFZ2S5HUXLNCAAO6S3SUVJA43I64CXYX7PA"},
+		{255, "BGOTRTO36FA65SS52RGD6B5TKHXKXBBXRNRNKSU6UDM6YXLJAC3A"},
+		{256, "OZDCVZWQW32CNVY25NIUMFFUAQJLMRAT7W5ACJZHGN5II6XCUT6A"},
+		{65536, "BDPYBZRSL6GCEKN37AZVH6CZHRYR3FWNNM34YYOUAGXOC2PZG75A"},
+		{-2, "5BC2BAFZYF4HKC67ZNSS32BFJYYBU7O2V7URR7CKCC325VIABG7A"},
+	} {
+		assert.Equal(t, tc.expected, parent.Derive(node, tc.num).String(), "num=%d", tc.num)
+		assert.Equal(t, tc.expected, parent.Deriver().Derive(node, tc.num).String(), "num=%d", tc.num)
+	}
+}
+
+func TestPieceID_LooksPlaceholder(t *testing.T) {
+	require.True(t, storj.PieceID{}.LooksPlaceholder())
+
+	var ones, incrementing, shifted storj.PieceID
+	for i := range ones {
+		ones[i] = 0xFF
+		incrementing[i] = byte(i)
+		shifted[i] = byte(i + 250)
+	}
+	require.True(t, ones.LooksPlaceholder())
+	require.True(t, incrementing.LooksPlaceholder())
+	require.True(t, shifted.LooksPlaceholder())
+
+	for i := 0; i < 10; i++ {
+		require.False(t, storj.NewPieceID().LooksPlaceholder())
+	}
+
+	almost := incrementing
+	almost[31] = 0
+	require.False(t, almost.LooksPlaceholder())
+}
+
+func TestNearestNodes(t *testing.T) {
+	target := storj.PieceID{0x0F}
+	nodes := []storj.NodeID{
+		{0xFF}, // distance 0xF0
+		{0x0E}, // distance 0x01
+		{0x1F}, // distance 0x10
+		{0x0F}, // distance 0x00
+		{0x00}, // distance 0x0F
+		{0x0E}, // distance 0x01, duplicate
+	}
+
+	require.Equal(t, []storj.NodeID{{0x0F}}, storj.NearestNodes(target, nodes, 1))
+	require.Equal(t, []storj.NodeID{{0x0F}, {0x0E}, {0x0E}}, storj.NearestNodes(target, nodes, 3))
+	require.Equal(t, []storj.NodeID{{0x0F}, {0x0E}, {0x0E}, {0x00}, {0x1F}, {0xFF}}, storj.NearestNodes(target, nodes, 6))
+	require.Equal(t, []storj.NodeID{{0x0F}, {0x0E}, {0x0E}, {0x00}, {0x1F}, {0xFF}}, storj.NearestNodes(target, nodes, 100))
+	require.Empty(t, storj.NearestNodes(target, nodes, 0))
+	require.Empty(t, storj.NearestNodes(target, nil, 3))
+
+	// compare against a full sort
+	random := make([]storj.NodeID, 100)
+	for i := range random {
+		random[i] = testrand.NodeID()
+	}
+	target = storj.NewPieceID()
+
+	sorted := append([]storj.NodeID(nil), random...)
+	sort.Slice(sorted, func(i, j int) bool {
+		var a, b storj.NodeID
+		for k := range a {
+			a[k] = sorted[i][k] ^ target[k]
+			b[k] = sorted[j][k] ^ target[k]
+		}
+		return a.Less(b)
+	})
+	require.Equal(t, sorted[:10], storj.NearestNodes(target, random, 10))
+}
+
+// fakeRows mimics *sql.Rows with a single column.
+type fakeRows struct {
+	values  []interface{}
+	next    int
+	scanErr error
+	err     error
+}
+
+func (rows *fakeRows) Next() bool {
+	if rows.next >= len(rows.values) {
+		return false
+	}
+	rows.next++
+	return true
+}
+
+func (rows *fakeRows) Scan(dest ...interface{}) error {
+	if rows.scanErr != nil {
+		return rows.scanErr
+	}
+	return dest[0].(*storj.PieceID).Scan(rows.values[rows.next-1])
+}
+
+func (rows *fakeRows) Err() error { return rows.err }
+
+func TestScanPieceIDs(t *testing.T) {
+	expected := storj.PieceIDList{storj.NewPieceID(), storj.NewPieceID(), storj.NewPieceID()}
+
+	var values []interface{}
+	for _, id := range expected {
+		values = append(values, id.Bytes())
+	}
+
+	ids, err := storj.ScanPieceIDs(&fakeRows{values: values})
+	require.NoError(t, err)
+	require.Equal(t, expected, ids)
+
+	ids, err = storj.ScanPieceIDs(&fakeRows{})
+	require.NoError(t, err)
+	require.Empty(t, ids)
+
+	_, err = storj.ScanPieceIDs(&fakeRows{values: append(values, []byte{1, 2, 3})})
+	require.Error(t, err)
+	require.True(t, storj.ErrPieceID.Has(err))
+
+	errScan := errors.New("scan failed")
+	_, err = storj.ScanPieceIDs(&fakeRows{values: values, scanErr: errScan})
+	require.ErrorIs(t, err, errScan)
+
+	errRows := errors.New("connection lost")
+	_, err = storj.ScanPieceIDs(&fakeRows{values: values, err: errRows})
+	require.ErrorIs(t, err, errRows)
+}
+
+func TestPieceIDDeriver_Derive64Golden(t *testing.T) {
+	parent, node := goldenDerivationInputs()
+	deriver := parent.Deriver()
+
+	for _, tc := range []struct {
+		num      int64
+		expected string
+	}{
+		{0, "W7K2P2DFZI2ISDZTBC7Z6PYVSFANRDZ2U5LW4TTFNLWYMA3HDSGA"},
+		{1, "4BF5D5BWO5Z6WUU2BPTP4NFDL5KGOJOKTFRMNO7RSFTLLLPYHLSQ"},
+		{math.MaxInt32, "CB5XNOOP4Z7XNPFLHS3GXGWJBKODZROT4XQR24I7LST62SXTNXWQ"},
+		{1 << 32, "EO76E72DIKWEN3BZ2XPMWA2HXWXUQ6GRPJQ7FPC52WRC6VN74FVQ"},
+		{math.MaxInt64, "E42IEV4LU6L75OQCB2ZDP27WLLS2QPRLQ6H2F4O64WWB5V5W745A"},
+		{-1, "PS3ZOFI3OPYF2IMRMRYTQ44LDO2D6BWYZU663YUZ5JSEFZFZFMAA"},
+	} {
+		assert.Equal(t, tc.expected, deriver.Derive64(node, tc.num).String(), "num=%d", tc.num)
+	}
+
+	// distinct from the 32-bit variant
+	for _, num := range []int32{0, 1, math.MaxInt32, -1} {
+		assert.NotEqual(t, deriver.Derive(node, num), deriver.Derive64(node, int64(num)), "num=%d", num)
+	}
+}
+
+func TestDeriveTracer(t *testing.T) {
+	type call struct {
+		parent, result storj.PieceID
+		node           storj.NodeID
+		num            int32
+	}
+
+	var calls []call
+	storj.DeriveTracer = func(parent storj.PieceID, node storj.NodeID, num int32, result storj.PieceID) {
+		calls = append(calls, call{parent: parent, result: result, node: node, num: num})
+	}
+	defer func() { storj.DeriveTracer = nil }()
+
+	parent := storj.NewPieceID()
+	node := testrand.NodeID()
+
+	derived := parent.Derive(node, 7)
+	require.Equal(t, []call{{parent: parent, result: derived, node: node, num: 7}}, calls)
+
+	storj.DeriveTracer = nil
+	_ = parent.Derive(node, 8)
+	require.Len(t, calls, 1)
+}
+
+func TestPieceIDPartitions(t *testing.T) {
+	maxID := storj.PieceID{}
+	for i := range maxID {
+		maxID[i] = 0xFF
+	}
+
+	require.Equal(t, []storj.PieceID{{}, {0x40}, {0x80}, {0xC0}, maxID}, storj.PieceIDPartitions(4))
+	require.Equal(t, []storj.PieceID{{}, maxID}, storj.PieceIDPartitions(1))
+
+	for _, n := range []int{1, 3, 7, 100} {
+		boundaries := storj.PieceIDPartitions(n)
+		require.Len(t, boundaries, n+1)
+		require.Equal(t, storj.PieceID{}, boundaries[0])
+		require.Equal(t, maxID, boundaries[n])
+		for i := 1; i < len(boundaries); i++ {
+			require.True(t, bytes.Compare(boundaries[i-1][:], boundaries[i][:]) < 0)
+		}
+
+		// every piece ID falls into exactly one partition
+		for k := 0; k < 100; k++ {
+			id := storj.NewPieceID()
+			matches := 0
+			for i := 0; i < n; i++ {
+				if id.InRange(boundaries[i], boundaries[i+1]) && (i == n-1 || id != boundaries[i+1]) {
+					matches++
+				}
+			}
+			require.Equal(t, 1, matches)
+		}
+	}
+
+	require.Panics(t, func() { storj.PieceIDPartitions(0) })
+}
+
+func TestPieceIDDeriver_DeriveIntoAllocations(t *testing.T) {
+	pieceID := storj.NewPieceID()
+	n0 := testidentity.MustPregeneratedIdentity(0, storj.LatestIDVersion()).ID
+	deriver := pieceID.Deriver()
+
+	var derived storj.PieceID
+	allocs := testing.AllocsPerRun(100, func() {
+		deriver.DeriveInto(n0, 0, &derived)
+	})
+	require.Zero(t, allocs, "DeriveInto on a reused deriver must not allocate")
+}
+
+func TestPieceID_FixedBytes(t *testing.T) {
+	id := storj.NewPieceID()
+	original := id
+
+	fixed := id.FixedBytes()
+	require.Equal(t, id.Bytes(), fixed[:])
+	require.Equal(t, id, storj.PieceIDFromFixed(fixed))
+
+	fixed[0] ^= 0xFF
+	require.Equal(t, original, id)
+}
+
+func TestSelfTestDerivation(t *testing.T) {
+	require.NoError(t, storj.SelfTestDerivation(0))
+	require.NoError(t, storj.SelfTestDerivation(1000))
+}
+
+func TestPieceIDsFromStrings(t *testing.T) {
+	expected := storj.PieceIDList{storj.NewPieceID(), storj.NewPieceID()}
+
+	ids, err := storj.PieceIDsFromStrings([]string{expected[0].String(), expected[1].String()})
+	require.NoError(t, err)
+	require.Equal(t, expected, ids)
+
+	_, err = storj.PieceIDsFromStrings([]string{expected[0].String(), "AB!D", expected[1].String(), "AAAA"})
+	require.Error(t, err)
+	require.True(t, storj.ErrPieceID.Has(err))
+	require.Contains(t, err.Error(), "index 1")
+	require.Contains(t, err.Error(), `'!'`)
+	require.Contains(t, err.Error(), "index 3")
+	require.Contains(t, err.Error(), "not enough bytes")
+}
+
+func TestPieceIDsFromReader(t *testing.T) {
+	a, b, c := storj.NewPieceID(), storj.NewPieceID(), storj.NewPieceID()
+	input := a.String() + "\n" +
+		"  " + b.String() + " \r\n" +
+		"\n" +
+		"not a piece id\n" +
+		c.String()
+
+	ids, lineErrs := storj.PieceIDsFromReader(strings.NewReader(input))
+	require.Equal(t, storj.PieceIDList{a, b, c}, ids)
+	require.Len(t, lineErrs, 1)
+	require.Equal(t, 4, lineErrs[0].Line)
+	require.True(t, storj.ErrPieceID.Has(lineErrs[0]))
+	require.Contains(t, lineErrs[0].Error(), "line 4")
+
+	ids, lineErrs = storj.PieceIDsFromReader(strings.NewReader(""))
+	require.Empty(t, ids)
+	require.Empty(t, lineErrs)
+}
+
+func TestPieceIDDeriver_DeriveStrict(t *testing.T) {
+	pieceID := storj.NewPieceID()
+	deriver := pieceID.Deriver()
+
+	_, err := deriver.DeriveStrict(storj.NodeID{}, 0)
+	require.Error(t, err)
+	require.True(t, storj.ErrPieceID.Has(err))
+
+	n0 := testidentity.MustPregeneratedIdentity(0, storj.LatestIDVersion()).ID
+	derived, err := deriver.DeriveStrict(n0, 3)
+	require.NoError(t, err)
+	require.Equal(t, pieceID.Derive(n0, 3), derived)
+}
+
+func TestPieceID_StringNoPadding(t *testing.T) {
+	var ones storj.PieceID
+	for i := range ones {
+		ones[i] = 0xFF
+	}
+
+	for _, id := range []storj.PieceID{{}, ones, storj.NewPieceID(), storj.NewPieceID()} {
+		s := id.String()
+		require.Len(t, s, 52)
+		require.NotContains(t, s, "=")
+		require.Equal(t, base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(id.Bytes()), s)
+	}
+}
+
+func TestPieceID_DeriveNodeIDLength(t *testing.T) {
+	// Derive mixes the full node ID into the mac. Changing the node ID size or
+	// its byte representation would change every derived piece ID.
+	require.Equal(t, 32, storj.NodeIDSize)
+	require.Len(t, storj.NodeID{}.Bytes(), storj.NodeIDSize)
+
+	parent, _ := goldenDerivationInputs()
+	var node storj.NodeID
+	for i := range node {
+		node[i] = 0xAB
+	}
+	require.Equal(t, "UHSGPDMA75URESW52KYYDQLVUVWMGBW2CDB6HDEDVXJZDQGTVUBA", parent.Derive(node, 42).String())
+}
+
+func TestVerifyPieceContent(t *testing.T) {
+	data := testrand.BytesInt(1024)
+	expected := storj.PieceID(sha256.Sum256(data))
+
+	require.True(t, storj.VerifyPieceContent(expected, data))
+	require.False(t, storj.VerifyPieceContent(expected, data[:1023]))
+	require.False(t, storj.VerifyPieceContent(storj.NewPieceID(), data))
+
+	empty := storj.PieceID(sha256.Sum256(nil))
+	require.True(t, storj.VerifyPieceContent(empty, nil))
+}
+
+func TestPieceID_DeriverForDomain(t *testing.T) {
+	pieceID := storj.NewPieceID()
+	n0 := testidentity.MustPregeneratedIdentity(0, storj.LatestIDVersion()).ID
+
+	require.Equal(t, pieceID.Derive(n0, 1), pieceID.DeriverForDomain("").Derive(n0, 1))
+
+	a := pieceID.DeriverForDomain("a").Derive(n0, 1)
+	b := pieceID.DeriverForDomain("b").Derive(n0, 1)
+	require.NotEqual(t, pieceID.Derive(n0, 1), a)
+	require.NotEqual(t, a, b)
+	require.Equal(t, a, pieceID.DeriverForDomain("a").Derive(n0, 1))
+
+	// domains differing only in trailing zero bytes must not collide
+	domains := []string{"", "\x00", "\x00\x00", "a", "a\x00", "a\x01", "a\x01\x00"}
+	seen := map[storj.PieceID]string{}
+	for _, domain := range domains {
+		derived := pieceID.DeriverForDomain(domain).Derive(n0, 1)
+		other, ok := seen[derived]
+		require.False(t, ok, "domains %q and %q collide", domain, other)
+		seen[derived] = domain
+	}
+
+	// golden value for the empty domain
+	parent, node := goldenDerivationInputs()
+	require.Equal(t, "YWQMMJZXJHBI4VFULVYAT5GDPH5Y62UZPAPLNLZE4YLJCPBWRRNA", parent.DeriverForDomain("").Derive(node, 0).String())
+}
+
+func TestPieceIDList_Sample(t *testing.T) {
+	list := make(storj.PieceIDList, 100)
+	for i := range list {
+		list[i] = storj.NewPieceID()
+	}
+
+	a := list.Sample(10, 1)
+	require.Len(t, a, 10)
+	require.Equal(t, a, list.Sample(10, 1))
+	require.NotEqual(t, a, list.Sample(10, 2))
+
+	seen := map[storj.PieceID]bool{}
+	for _, id := range a {
+		require.False(t, seen[id], "duplicate")
+		seen[id] = true
+		require.Contains(t, list, id)
+	}
+
+	require.Equal(t, list, list.Sample(100, 1))
+	require.Equal(t, list, list.Sample(1000, 1))
+	require.Empty(t, list.Sample(0, 1))
+	require.Empty(t, storj.PieceIDList(nil).Sample(5, 1))
+}
+
+func TestPieceID_DeriveTruncation(t *testing.T) {
+	parent, node := goldenDerivationInputs()
+
+	mac := hmac.New(sha512.New, parent.Bytes())
+	_, _ = mac.Write(node.Bytes())
+	_, _ = mac.Write([]byte{0, 0, 0, 5})
+	sum := mac.Sum(nil)
+	require.Len(t, sum, 64)
+
+	derived := parent.Derive(node, 5)
+	require.Equal(t, sum[:32], derived.Bytes())
+}
+
+func TestPieceID_DerivePartiallyZeroNodeID(t *testing.T) {
+	parent, node := goldenDerivationInputs()
+
+	// A NodeID is a fixed-size array, a short node ID can only be constructed
+	// by leaving the remaining bytes zero. Derive always mixes in all of them.
+	var partial storj.NodeID
+	copy(partial[:], node[:16])
+
+	_, err := storj.NodeIDFromBytes(node[:16])
+	require.Error(t, err)
+
+	derived := parent.Derive(partial, 0)
+	require.NotEqual(t, parent.Derive(node, 0), derived)
+	require.Equal(t, "VVQ4YI33GRNVP7FV4ECJOAZKAMWZX2XK5GZXPB3IRP5UNJ7QXHRQ", derived.String())
+
+	strict, err := parent.Deriver().DeriveStrict(partial, 0)
+	require.NoError(t, err)
+	require.Equal(t, derived, strict)
+}
+
+func TestPieceIDInterner(t *testing.T) {
+	interner := storj.NewPieceIDInterner()
+
+	a, b := storj.NewPieceID(), storj.NewPieceID()
+
+	first := interner.Intern(a)
+	second := interner.Intern(a)
+	require.Equal(t, a, *first)
+	require.Equal(t, *first, *second)
+	require.Same(t, first, second)
+
+	other := interner.Intern(b)
+	require.Equal(t, b, *other)
+	require.NotSame(t, first, other)
+	require.Equal(t, 2, interner.Len())
+}
+
 func BenchmarkDeriver(b *testing.B) {
 	pieceID := storj.NewPieceID()
 	n0 := testidentity.MustPregeneratedIdentity(0, storj.LatestIDVersion()).ID
@@ -126,3 +1116,80 @@ func BenchmarkDeriver(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkPieceIDFromString(b *testing.B) {
+	s := storj.NewPieceID().String()
+
+	b.Run("FromString", func(b *testing.B) {
+		b.ReportAllocs()
+		for k := 0; k < b.N; k++ {
+			_, _ = storj.PieceIDFromString(s)
+		}
+	})
+
+	b.Run("FromStringInto", func(b *testing.B) {
+		b.ReportAllocs()
+		var id storj.PieceID
+		for k := 0; k < b.N; k++ {
+			_ = storj.PieceIDFromStringInto(s, &id)
+		}
+	})
+}
+
+func BenchmarkDeriveReuse(b *testing.B) {
+	pieceID := storj.NewPieceID()
+	n0 := testidentity.MustPregeneratedIdentity(0, storj.LatestIDVersion()).ID
+	deriver := pieceID.Deriver()
+
+	b.ReportAllocs()
+	var derived storj.PieceID
+	for k := 0; k < b.N; k++ {
+		deriver.DeriveInto(n0, int32(k), &derived)
+	}
+}
+
+func BenchmarkDeriveParallel(b *testing.B) {
+	pieceID := storj.NewPieceID()
+	nodes := make([]storj.NodeID, 1000)
+	for i := range nodes {
+		nodes[i] = testrand.NodeID()
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for k := 0; k < b.N; k++ {
+				_ = pieceID.DeriveParallel(nodes, 0, workers)
+			}
+		})
+	}
+}
+
+func BenchmarkPieceIDInterner(b *testing.B) {
+	const distinct = 1000
+	ids := make([]storj.PieceID, distinct)
+	for i := range ids {
+		ids[i] = storj.NewPieceID()
+	}
+
+	b.Run("Copies", func(b *testing.B) {
+		b.ReportAllocs()
+		for k := 0; k < b.N; k++ {
+			held := make([]*storj.PieceID, 0, 10*distinct)
+			for i := 0; i < 10*distinct; i++ {
+				id := ids[i%distinct]
+				held = append(held, &id)
+			}
+		}
+	})
+
+	b.Run("Interned", func(b *testing.B) {
+		b.ReportAllocs()
+		for k := 0; k < b.N; k++ {
+			interner := storj.NewPieceIDInterner()
+			held := make([]*storj.PieceID, 0, 10*distinct)
+			for i := 0; i < 10*distinct; i++ {
+				held = append(held, interner.Intern(ids[i%distinct]))
+			}
+		}
+	})
+}
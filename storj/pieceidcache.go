@@ -0,0 +1,86 @@
+// Copyright (C) 2022 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package storj
+
+import (
+	"container/list"
+	"sync"
+)
+
+// PieceIDCache is a least-recently-used cache keyed by PieceID.
+//
+// The module still targets Go 1.17, hence values are stored as interface{}
+// rather than using a type parameter.
+type PieceIDCache struct {
+	mu       sync.Mutex
+	capacity int
+	data     map[PieceID]*list.Element
+	order    *list.List
+}
+
+// pieceIDCacheEntry is an entry in PieceIDCache.order.
+type pieceIDCacheEntry struct {
+	id    PieceID
+	value interface{}
+}
+
+// NewPieceIDCache creates a cache holding at most capacity entries.
+// A non-positive capacity disables caching.
+func NewPieceIDCache(capacity int) *PieceIDCache {
+	if capacity < 0 {
+		capacity = 0
+	}
+	return &PieceIDCache{
+		capacity: capacity,
+		data:     make(map[PieceID]*list.Element, capacity),
+		order:    list.New(),
+	}
+}
+
+// Get returns the value for id and marks it as recently used.
+func (cache *PieceIDCache) Get(id PieceID) (value interface{}, ok bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	elem, ok := cache.data[id]
+	if !ok {
+		return nil, false
+	}
+
+	cache.order.MoveToFront(elem)
+	return elem.Value.(*pieceIDCacheEntry).value, true
+}
+
+// Put adds or replaces the value for id, evicting the least recently used
+// entry when the cache is full.
+func (cache *PieceIDCache) Put(id PieceID, value interface{}) {
+	if cache.capacity <= 0 {
+		return
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if elem, ok := cache.data[id]; ok {
+		elem.Value.(*pieceIDCacheEntry).value = value
+		cache.order.MoveToFront(elem)
+		return
+	}
+
+	for cache.order.Len() >= cache.capacity {
+		back := cache.order.Back()
+		delete(cache.data, back.Value.(*pieceIDCacheEntry).id)
+		cache.order.Remove(back)
+	}
+
+	cache.data[id] = cache.order.PushFront(&pieceIDCacheEntry{id: id, value: value})
+}
+
+// Len returns the number of cached entries.
+func (cache *PieceIDCache) Len() int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	return cache.order.Len()
+}
@@ -0,0 +1,61 @@
+// Copyright (C) 2022 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package storj_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"storj.io/common/storj"
+)
+
+func TestPieceIDCache(t *testing.T) {
+	a, b, c := storj.NewPieceID(), storj.NewPieceID(), storj.NewPieceID()
+
+	cache := storj.NewPieceIDCache(2)
+	cache.Put(a, 1)
+	cache.Put(b, 2)
+	require.Equal(t, 2, cache.Len())
+
+	// touch a, so b becomes the least recently used
+	value, ok := cache.Get(a)
+	require.True(t, ok)
+	require.Equal(t, 1, value)
+
+	cache.Put(c, 3)
+	require.Equal(t, 2, cache.Len())
+
+	_, ok = cache.Get(b)
+	require.False(t, ok)
+
+	value, ok = cache.Get(c)
+	require.True(t, ok)
+	require.Equal(t, 3, value)
+
+	// replacing doesn't evict
+	cache.Put(c, 4)
+	require.Equal(t, 2, cache.Len())
+	value, ok = cache.Get(c)
+	require.True(t, ok)
+	require.Equal(t, 4, value)
+
+	// a is now the least recently used
+	cache.Put(b, 5)
+	_, ok = cache.Get(a)
+	require.False(t, ok)
+	_, ok = cache.Get(c)
+	require.True(t, ok)
+}
+
+func TestPieceIDCache_Disabled(t *testing.T) {
+	id := storj.NewPieceID()
+
+	cache := storj.NewPieceIDCache(0)
+	cache.Put(id, 1)
+	require.Equal(t, 0, cache.Len())
+
+	_, ok := cache.Get(id)
+	require.False(t, ok)
+}
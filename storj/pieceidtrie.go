@@ -0,0 +1,131 @@
+// Copyright (C) 2022 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package storj
+
+import (
+	"bytes"
+	"sort"
+)
+
+// PieceIDTrie is a byte-wise prefix tree of piece IDs. The zero value is an
+// empty trie ready to use. It's not safe for concurrent use.
+type PieceIDTrie struct {
+	root pieceIDTrieNode
+	len  int
+}
+
+// pieceIDTrieNode is a node of PieceIDTrie. The children are sorted by their
+// byte, so that walking the trie results in lexicographic order.
+//
+// A piece ID is stored in a leaf as soon as its prefix is unique, instead of
+// adding a node for each of its remaining bytes.
+type pieceIDTrieNode struct {
+	bytes    []byte
+	children []*pieceIDTrieNode
+
+	leaf bool
+	id   PieceID
+}
+
+// child returns the child for b and its position, or nil and the position
+// where it should be inserted.
+func (node *pieceIDTrieNode) child(b byte) (*pieceIDTrieNode, int) {
+	i := sort.Search(len(node.bytes), func(i int) bool { return node.bytes[i] >= b })
+	if i < len(node.bytes) && node.bytes[i] == b {
+		return node.children[i], i
+	}
+	return nil, i
+}
+
+// insert adds child for b at position i.
+func (node *pieceIDTrieNode) insert(i int, b byte, child *pieceIDTrieNode) {
+	node.bytes = append(node.bytes, 0)
+	copy(node.bytes[i+1:], node.bytes[i:])
+	node.bytes[i] = b
+	node.children = append(node.children, nil)
+	copy(node.children[i+1:], node.children[i:])
+	node.children[i] = child
+}
+
+// Insert adds the piece ID to the trie. Inserting the same piece ID more than
+// once has no effect.
+func (trie *PieceIDTrie) Insert(id PieceID) {
+	node := &trie.root
+	for depth := 0; ; depth++ {
+		next, i := node.child(id[depth])
+		if next == nil {
+			node.insert(i, id[depth], &pieceIDTrieNode{leaf: true, id: id})
+			trie.len++
+			return
+		}
+		if !next.leaf {
+			node = next
+			continue
+		}
+		if next.id == id {
+			return
+		}
+
+		// The prefix of the leaf isn't unique anymore, so replace it with
+		// nodes for the common bytes and put both piece IDs below them.
+		existing := next
+		next = &pieceIDTrieNode{}
+		node.children[i] = next
+		for depth++; id[depth] == existing.id[depth]; depth++ {
+			common := &pieceIDTrieNode{}
+			next.insert(0, id[depth], common)
+			next = common
+		}
+		added := &pieceIDTrieNode{leaf: true, id: id}
+		if id[depth] < existing.id[depth] {
+			next.insert(0, id[depth], added)
+			next.insert(1, existing.id[depth], existing)
+		} else {
+			next.insert(0, existing.id[depth], existing)
+			next.insert(1, id[depth], added)
+		}
+		trie.len++
+		return
+	}
+}
+
+// Len returns the number of piece IDs in the trie.
+func (trie *PieceIDTrie) Len() int { return trie.len }
+
+// PrefixMatch returns all piece IDs in the trie starting with prefix, in
+// lexicographic order.
+func (trie *PieceIDTrie) PrefixMatch(prefix []byte) PieceIDList {
+	if len(prefix) > len(PieceID{}) {
+		return nil
+	}
+
+	node := &trie.root
+	for _, b := range prefix {
+		node, _ = node.child(b)
+		if node == nil {
+			return nil
+		}
+		if node.leaf {
+			if !bytes.HasPrefix(node.id[:], prefix) {
+				return nil
+			}
+			return PieceIDList{node.id}
+		}
+	}
+
+	var matches PieceIDList
+	var walk func(node *pieceIDTrieNode)
+	walk = func(node *pieceIDTrieNode) {
+		if node.leaf {
+			matches = append(matches, node.id)
+			return
+		}
+		for _, child := range node.children {
+			walk(child)
+		}
+	}
+	walk(node)
+
+	return matches
+}
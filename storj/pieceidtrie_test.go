@@ -0,0 +1,103 @@
+// Copyright (C) 2022 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package storj_test
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"storj.io/common/storj"
+)
+
+func TestPieceIDTrie(t *testing.T) {
+	var trie storj.PieceIDTrie
+	require.Empty(t, trie.PrefixMatch(nil))
+
+	a := storj.PieceID{0x01, 0x02, 0x03}
+	b := storj.PieceID{0x01, 0x02, 0x04}
+	c := storj.PieceID{0x01, 0x05}
+	d := storj.PieceID{0x02}
+
+	for _, id := range []storj.PieceID{d, b, c, a, b} {
+		trie.Insert(id)
+	}
+	require.Equal(t, 4, trie.Len())
+
+	require.Equal(t, storj.PieceIDList{a, b, c, d}, trie.PrefixMatch(nil))
+	require.Equal(t, storj.PieceIDList{a, b, c}, trie.PrefixMatch([]byte{0x01}))
+	require.Equal(t, storj.PieceIDList{a, b}, trie.PrefixMatch([]byte{0x01, 0x02}))
+	require.Equal(t, storj.PieceIDList{b}, trie.PrefixMatch([]byte{0x01, 0x02, 0x04}))
+	require.Equal(t, storj.PieceIDList{d}, trie.PrefixMatch(d[:]))
+	require.Empty(t, trie.PrefixMatch([]byte{0x03}))
+	require.Empty(t, trie.PrefixMatch(append(d.Bytes(), 0)))
+
+	// piece IDs only differing in the last byte
+	e := storj.PieceID{0x01, 0x02, 0x04}
+	e[len(e)-1] = 0xFF
+	trie.Insert(e)
+	trie.Insert(e)
+	require.Equal(t, 5, trie.Len())
+	require.Equal(t, storj.PieceIDList{a, b, e, c, d}, trie.PrefixMatch(nil))
+	require.Equal(t, storj.PieceIDList{b, e}, trie.PrefixMatch([]byte{0x01, 0x02, 0x04}))
+	require.Equal(t, storj.PieceIDList{e}, trie.PrefixMatch(e[:]))
+	require.Empty(t, trie.PrefixMatch([]byte{0x02, 0x01}))
+}
+
+func TestPieceIDTrie_Random(t *testing.T) {
+	var trie storj.PieceIDTrie
+
+	ids := make(storj.PieceIDList, 1000)
+	for i := range ids {
+		ids[i] = storj.NewPieceID()
+		trie.Insert(ids[i])
+	}
+	require.Equal(t, len(ids), trie.Len())
+
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+	require.Equal(t, ids, trie.PrefixMatch(nil))
+
+	prefix := ids[500][:1]
+	var expected storj.PieceIDList
+	for _, id := range ids {
+		if bytes.HasPrefix(id[:], prefix) {
+			expected = append(expected, id)
+		}
+	}
+	require.Equal(t, expected, trie.PrefixMatch(prefix))
+}
+
+func TestPieceIDTrie_InsertAllocations(t *testing.T) {
+	var trie storj.PieceIDTrie
+
+	ids := make(storj.PieceIDList, 10000)
+	for i := range ids {
+		ids[i] = storj.NewPieceID()
+	}
+
+	next := 0
+	allocs := testing.AllocsPerRun(len(ids)-1, func() {
+		trie.Insert(ids[next])
+		next++
+	})
+	require.Equal(t, len(ids), trie.Len())
+	// a leaf, a few splits and occasionally growing the children
+	require.LessOrEqual(t, allocs, 4.0)
+}
+
+func BenchmarkPieceIDTrie_Insert(b *testing.B) {
+	ids := make(storj.PieceIDList, b.N)
+	for i := range ids {
+		ids[i] = storj.NewPieceID()
+	}
+
+	var trie storj.PieceIDTrie
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Insert(ids[i])
+	}
+}